@@ -3,6 +3,7 @@ package consul
 import (
 	"fmt"
 	"sort"
+	"sync"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/acl"
@@ -15,6 +16,18 @@ import (
 // Health endpoint is used to query the health information
 type Health struct {
 	srv *Server
+
+	// publisher and publisherOnce back SubscribeServiceNodes. They're kept
+	// on Health rather than Server since nothing else needs them, and
+	// initialized lazily so callers that never subscribe don't pay for it.
+	publisher     *serviceHealthPublisher
+	publisherOnce sync.Once
+
+	// pageCursorsReg and pageCursorsOnce back the PageSize/PageToken
+	// pagination supported by ServiceNodes, ChecksInState, and
+	// ServiceChecks, initialized lazily for the same reason as publisher.
+	pageCursorsReg  *cursorRegistry
+	pageCursorsOnce sync.Once
 }
 
 // ChecksInState is used to get all the checks in a given state
@@ -38,10 +51,15 @@ func (h *Health) ChecksInState(args *structs.ChecksInStateRequest,
 		return err
 	}
 
+	queryOpts := h.pagingQueryOptions(args.QueryOptions)
 	return h.srv.blockingQuery(
-		&args.QueryOptions,
+		&queryOpts,
 		&reply.QueryMeta,
 		func(ws memdb.WatchSet, state *state.Store) error {
+			if h.continuingCachedPage(args.Token, args.PageToken) {
+				return h.paginateHealthChecks(args.Token, args.PageSize, args.PageToken, reply)
+			}
+
 			var index uint64
 			var checks structs.HealthChecks
 			var err error
@@ -64,7 +82,10 @@ func (h *Health) ChecksInState(args *structs.ChecksInStateRequest,
 			}
 			reply.HealthChecks = raw.(structs.HealthChecks)
 
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks)
+			if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks); err != nil {
+				return err
+			}
+			return h.paginateHealthChecks(args.Token, args.PageSize, args.PageToken, reply)
 		})
 }
 
@@ -139,10 +160,15 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 		return err
 	}
 
+	queryOpts := h.pagingQueryOptions(args.QueryOptions)
 	return h.srv.blockingQuery(
-		&args.QueryOptions,
+		&queryOpts,
 		&reply.QueryMeta,
 		func(ws memdb.WatchSet, state *state.Store) error {
+			if h.continuingCachedPage(args.Token, args.PageToken) {
+				return h.paginateHealthChecks(args.Token, args.PageSize, args.PageToken, reply)
+			}
+
 			var index uint64
 			var checks structs.HealthChecks
 			var err error
@@ -165,7 +191,10 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 			}
 			reply.HealthChecks = raw.(structs.HealthChecks)
 
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks)
+			if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks); err != nil {
+				return err
+			}
+			return h.paginateHealthChecks(args.Token, args.PageSize, args.PageToken, reply)
 		})
 }
 
@@ -230,15 +259,7 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	}
 
 	// Determine the function we'll call
-	var f func(memdb.WatchSet, *state.Store, *structs.ServiceSpecificRequest) (uint64, structs.CheckServiceNodes, error)
-	switch {
-	case args.Connect:
-		f = h.serviceNodesConnect
-	case args.TagFilter:
-		f = h.serviceNodesTagFilter
-	default:
-		f = h.serviceNodesDefault
-	}
+	f := h.serviceNodesFunc(args)
 
 	var authzContext acl.AuthorizerContext
 	authz, err := h.srv.ResolveTokenAndDefaultMeta(args.Token, &args.EnterpriseMeta, &authzContext)
@@ -264,10 +285,15 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 		return err
 	}
 
+	queryOpts := h.pagingQueryOptions(args.QueryOptions)
 	err = h.srv.blockingQuery(
-		&args.QueryOptions,
+		&queryOpts,
 		&reply.QueryMeta,
 		func(ws memdb.WatchSet, state *state.Store) error {
+			if h.continuingCachedPage(args.Token, args.PageToken) {
+				return h.paginateCheckServiceNodes(args.Token, args.PageSize, args.PageToken, reply)
+			}
+
 			index, nodes, err := f(ws, state, args)
 			if err != nil {
 				return err
@@ -288,7 +314,15 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 			}
 			reply.Nodes = raw.(structs.CheckServiceNodes)
 
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes)
+			if args.Order != "" {
+				reply.Nodes, err = applyResultOrder(args, reply.Nodes)
+				if err != nil {
+					return err
+				}
+			} else if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes); err != nil {
+				return err
+			}
+			return h.paginateCheckServiceNodes(args.Token, args.PageSize, args.PageToken, reply)
 		})
 
 	// Provide some metrics
@@ -0,0 +1,103 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	bexpr "github.com/hashicorp/go-bexpr"
+	"github.com/hashicorp/go-memdb"
+)
+
+// MultiServiceNodes returns CheckServiceNodes for every service named in
+// args.ServiceNames, all computed against a single memdb snapshot and
+// reported under one combined X-Consul-Index.
+//
+// Composing this from N calls to ServiceNodes would let each service's
+// result settle at a different index, so a caller that depends on several
+// services at once (e.g. to make a canary routing decision) has to stitch
+// together inconsistent views by hand. MultiServiceNodes instead takes the
+// whole answer from one blockingQuery call, so every service in the reply
+// reflects the exact same point in time and the RPC count doesn't grow with
+// the number of services a caller needs.
+func (h *Health) MultiServiceNodes(args *structs.ServiceListRequest, reply *structs.IndexedMultiCheckServiceNodes) error {
+	if done, err := h.srv.forward("Health.MultiServiceNodes", args, args, reply); done {
+		return err
+	}
+
+	if len(args.ServiceNames) == 0 {
+		return fmt.Errorf("Must provide at least one service name")
+	}
+
+	_, err := h.srv.ResolveTokenAndDefaultMeta(args.Token, &args.EnterpriseMeta, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := h.srv.validateEnterpriseRequest(&args.EnterpriseMeta, false); err != nil {
+		return err
+	}
+
+	// The same bexpr expression is applied to every service's result, so one
+	// compiled filter can be reused rather than recompiling it per service.
+	filter, err := bexpr.CreateFilter(args.Filter, nil, structs.CheckServiceNodes{})
+	if err != nil {
+		return err
+	}
+
+	return h.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, s *state.Store) error {
+			results := make(map[string]structs.CheckServiceNodes, len(args.ServiceNames))
+
+			var maxIndex uint64
+			for _, name := range args.ServiceNames {
+				var (
+					index uint64
+					nodes structs.CheckServiceNodes
+					err   error
+				)
+				if tags, ok := args.ServiceTagFilters[name]; ok && len(tags) > 0 {
+					index, nodes, err = s.CheckServiceTagNodes(ws, name, tags, &args.EnterpriseMeta)
+				} else {
+					index, nodes, err = s.CheckServiceNodes(ws, name, &args.EnterpriseMeta)
+				}
+				if err != nil {
+					return err
+				}
+				if index > maxIndex {
+					maxIndex = index
+				}
+
+				filtered, err := filterMultiServiceNodesACL(h.srv.filterACL, args.Token, nodes)
+				if err != nil {
+					return err
+				}
+
+				raw, err := filter.Execute(filtered)
+				if err != nil {
+					return err
+				}
+				results[name] = raw.(structs.CheckServiceNodes)
+			}
+
+			reply.Index = maxIndex
+			reply.NodesByService = results
+			return nil
+		})
+}
+
+// filterMultiServiceNodesACL applies filterACL to one service's nodes in
+// isolation, pulled out of MultiServiceNodes' per-service loop so it can be
+// exercised without a *Server. filterACL only knows how to strip entries
+// from the per-service IndexedCheckServiceNodes shape, not the combined
+// NodesByService map, so this must be called once per service rather than
+// once on the combined reply as a whole.
+func filterMultiServiceNodesACL(filterACL func(token string, subj interface{}) error, token string, nodes structs.CheckServiceNodes) (structs.CheckServiceNodes, error) {
+	reply := &structs.IndexedCheckServiceNodes{Nodes: nodes}
+	if err := filterACL(token, reply); err != nil {
+		return nil, err
+	}
+	return reply.Nodes, nil
+}
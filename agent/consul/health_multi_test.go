@@ -0,0 +1,69 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+var errTestACL = errors.New("acl denied")
+
+// fakeFilterACLStripping simulates filterACL stripping one particular node name from
+// whatever IndexedCheckServiceNodes it's given, regardless of token - real
+// filterACL would also consult the token, but the behavior under test here
+// is isolation between services, not ACL correctness itself.
+func fakeFilterACLStripping(denyNode string) func(string, interface{}) error {
+	return func(_ string, subj interface{}) error {
+		reply := subj.(*structs.IndexedCheckServiceNodes)
+		var kept structs.CheckServiceNodes
+		for _, n := range reply.Nodes {
+			if n.Node.Node != denyNode {
+				kept = append(kept, n)
+			}
+		}
+		reply.Nodes = kept
+		return nil
+	}
+}
+
+func TestFilterMultiServiceNodesACL_PerServiceIsolation(t *testing.T) {
+	webNodes := structs.CheckServiceNodes{
+		{Node: &structs.Node{Node: "n1"}, Service: &structs.NodeService{ID: "web1"}},
+		{Node: &structs.Node{Node: "n2"}, Service: &structs.NodeService{ID: "web2"}},
+	}
+	dbNodes := structs.CheckServiceNodes{
+		{Node: &structs.Node{Node: "n1"}, Service: &structs.NodeService{ID: "db1"}},
+		{Node: &structs.Node{Node: "n2"}, Service: &structs.NodeService{ID: "db2"}},
+	}
+
+	// A token that can't see n1's web instance must not also strip n1 from
+	// the unrelated db service's result.
+	filtered, err := filterMultiServiceNodesACL(fakeFilterACLStripping("n1"), "token", webNodes)
+	if err != nil {
+		t.Fatalf("web: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].Node.Node != "n2" {
+		t.Fatalf("web filtered = %+v, want only n2", filtered)
+	}
+
+	dbFiltered, err := filterMultiServiceNodesACL(fakeFilterACLStripping("n2"), "token", dbNodes)
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	if len(dbFiltered) != 1 || dbFiltered[0].Node.Node != "n1" {
+		t.Fatalf("db filtered = %+v, want only n1", dbFiltered)
+	}
+
+	// The db result must be untouched by the web service's filtering pass.
+	if len(dbNodes) != 2 {
+		t.Fatalf("dbNodes mutated by web's filter pass: %+v", dbNodes)
+	}
+}
+
+func TestFilterMultiServiceNodesACL_PropagatesError(t *testing.T) {
+	boom := func(string, interface{}) error { return errTestACL }
+	if _, err := filterMultiServiceNodesACL(boom, "token", nil); err != errTestACL {
+		t.Fatalf("err = %v, want errTestACL", err)
+	}
+}
@@ -0,0 +1,138 @@
+package consul
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// Ordering modes selectable via ServiceSpecificRequest.Order. These let a
+// caller use Consul's health endpoint directly as a client-side load
+// balancer instead of composing near= sorting with its own logic, or
+// standing up a separate xDS layer for simple cases.
+const (
+	// orderWeightedRandom samples without replacement using each instance's
+	// Weights.Passing/Weights.Warning, so instances with a higher weight are
+	// more likely to sort earlier.
+	//
+	// order=least-connections is deliberately not implemented: it would need
+	// a per-instance load counter reported by agents, and nothing in this
+	// series gives agents a path to report one, so the field would always
+	// read zero and the mode would be a no-op dressed up as real load
+	// balancing. Add it back only alongside that reporting path.
+	orderWeightedRandom = "weighted-random"
+
+	// orderShuffleShard restricts the result to a caller-specific subset of
+	// at most ShardSize instances, selected deterministically by rendezvous
+	// (highest random weight) hashing on ShardKey, so repeated calls with
+	// the same ShardKey consistently land on the same shard of instances
+	// and no single caller's traffic fans out to the whole instance set.
+	orderShuffleShard = "shuffle-shard"
+)
+
+// shuffleShardDefaultSize is the shard size used when a shuffle-shard
+// request doesn't specify one.
+const shuffleShardDefaultSize = 3
+
+// applyResultOrder reorders (and, for shuffle-shard, subsets) nodes
+// according to args.Order. ServiceNodes calls it in place of the near=
+// distance sort applied by sortNodesByDistanceFrom, which is skipped
+// whenever args.Order is set. It returns nodes unchanged if args.Order is
+// empty.
+func applyResultOrder(args *structs.ServiceSpecificRequest, nodes structs.CheckServiceNodes) (structs.CheckServiceNodes, error) {
+	switch args.Order {
+	case "":
+		return nodes, nil
+	case orderWeightedRandom:
+		orderByWeightedRandom(nodes)
+		return nodes, nil
+	case orderShuffleShard:
+		return orderByShuffleShard(nodes, args.ShardKey, args.ShardSize), nil
+	default:
+		return nil, fmt.Errorf("Unsupported order %q", args.Order)
+	}
+}
+
+// orderByWeightedRandom samples nodes without replacement, weighted by each
+// instance's passing/warning weight, and reorders them in place so that
+// higher-weighted instances are more likely to come first.
+func orderByWeightedRandom(nodes structs.CheckServiceNodes) {
+	remaining := append(structs.CheckServiceNodes(nil), nodes...)
+	for i := 0; i < len(nodes); i++ {
+		total := 0
+		for _, n := range remaining {
+			total += nodeWeight(n)
+		}
+		if total <= 0 {
+			copy(nodes[i:], remaining)
+			return
+		}
+
+		pick := rand.Intn(total)
+		for j, n := range remaining {
+			pick -= nodeWeight(n)
+			if pick < 0 {
+				nodes[i] = n
+				remaining = append(remaining[:j], remaining[j+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// nodeWeight returns the weight to use for weighted-random sampling: the
+// Passing weight for healthy instances and the Warning weight otherwise,
+// falling back to 1 if the service didn't report weights.
+func nodeWeight(n structs.CheckServiceNode) int {
+	weights := n.Service.Weights
+	if weights.Passing <= 0 && weights.Warning <= 0 {
+		return 1
+	}
+	if n.Checks.AggregatedStatus() == "passing" {
+		return weights.Passing
+	}
+	return weights.Warning
+}
+
+// orderByShuffleShard returns a new slice holding at most shardSize
+// instances (shuffleShardDefaultSize if shardSize <= 0), chosen by ranking
+// every instance with rendezvous (HRW) hashing on shardKey and keeping the
+// top-ranked ones. Because the ranking only depends on (shardKey, instance
+// identity), the same shardKey keeps resolving to the same instances as
+// other instances are added or removed elsewhere in the list.
+func orderByShuffleShard(nodes structs.CheckServiceNodes, shardKey string, shardSize int) structs.CheckServiceNodes {
+	if shardSize <= 0 {
+		shardSize = shuffleShardDefaultSize
+	}
+
+	ranked := append(structs.CheckServiceNodes(nil), nodes...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return rendezvousWeight(shardKey, shuffleShardMember(ranked[i])) > rendezvousWeight(shardKey, shuffleShardMember(ranked[j]))
+	})
+
+	if shardSize < len(ranked) {
+		ranked = ranked[:shardSize]
+	}
+	return ranked
+}
+
+// shuffleShardMember returns the identity rendezvous hashing ranks an
+// instance by.
+func shuffleShardMember(n structs.CheckServiceNode) string {
+	return n.Node.Node + "/" + n.Service.ID
+}
+
+// rendezvousWeight computes the highest-random-weight score for a given
+// (shardKey, member) pair. Hashing shardKey and member together, rather than
+// hashing member alone, means each distinct shardKey gets its own
+// independent ranking of the same member set.
+func rendezvousWeight(shardKey, member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(shardKey))
+	h.Write([]byte{0})
+	h.Write([]byte(member))
+	return h.Sum64()
+}
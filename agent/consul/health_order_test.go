@@ -0,0 +1,75 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+func nodeFor(node, serviceID string) structs.CheckServiceNode {
+	return structs.CheckServiceNode{
+		Node:    &structs.Node{Node: node},
+		Service: &structs.NodeService{ID: serviceID},
+	}
+}
+
+func TestOrderByShuffleShard_DeterministicAndSubsets(t *testing.T) {
+	nodes := structs.CheckServiceNodes{
+		nodeFor("n1", "s1"),
+		nodeFor("n2", "s1"),
+		nodeFor("n3", "s1"),
+		nodeFor("n4", "s1"),
+		nodeFor("n5", "s1"),
+	}
+
+	first := orderByShuffleShard(nodes, "shard-key", 2)
+	if len(first) != 2 {
+		t.Fatalf("len(first) = %d, want 2", len(first))
+	}
+
+	// Repeating with the same shardKey and the same instance set must pick
+	// the exact same members in the exact same order every time.
+	second := orderByShuffleShard(nodes, "shard-key", 2)
+	for i := range first {
+		if shuffleShardMember(first[i]) != shuffleShardMember(second[i]) {
+			t.Fatalf("shard not deterministic: %v vs %v", first, second)
+		}
+	}
+
+	// A different shardKey is not guaranteed to land on a different subset,
+	// but it must still respect ShardSize and still be internally consistent.
+	other := orderByShuffleShard(nodes, "other-key", 2)
+	if len(other) != 2 {
+		t.Fatalf("len(other) = %d, want 2", len(other))
+	}
+}
+
+func TestOrderByShuffleShard_DefaultSize(t *testing.T) {
+	nodes := structs.CheckServiceNodes{
+		nodeFor("n1", "s1"),
+		nodeFor("n2", "s1"),
+		nodeFor("n3", "s1"),
+		nodeFor("n4", "s1"),
+	}
+
+	got := orderByShuffleShard(nodes, "shard-key", 0)
+	if len(got) != shuffleShardDefaultSize {
+		t.Fatalf("len(got) = %d, want default %d", len(got), shuffleShardDefaultSize)
+	}
+}
+
+func TestOrderByShuffleShard_SizeLargerThanInput(t *testing.T) {
+	nodes := structs.CheckServiceNodes{nodeFor("n1", "s1"), nodeFor("n2", "s1")}
+
+	got := orderByShuffleShard(nodes, "shard-key", 10)
+	if len(got) != len(nodes) {
+		t.Fatalf("len(got) = %d, want %d (can't return more than the input)", len(got), len(nodes))
+	}
+}
+
+func TestApplyResultOrder_UnsupportedOrder(t *testing.T) {
+	args := &structs.ServiceSpecificRequest{OrderOptions: structs.OrderOptions{Order: "bogus"}}
+	if _, err := applyResultOrder(args, nil); err == nil {
+		t.Fatal("expected an error for an unsupported order")
+	}
+}
@@ -0,0 +1,362 @@
+package consul
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// cursorTTL bounds how long an idle server-side cursor is kept alive. A
+// cursor older than this is evicted and the next page request for it falls
+// back to starting over from PageToken="".
+const cursorTTL = 2 * time.Minute
+
+// cursor pins one multi-page ServiceNodes/ChecksInState/ServiceChecks query
+// to the index and full result set its first page was computed from. Every
+// later page of the same query is sliced out of healthChecks/
+// checkServiceNodes directly - never by re-running the query against
+// current state - so pagination stays consistent even if writes land
+// between pages. Exactly one of the two result fields is populated,
+// depending on which endpoint started the cursor.
+//
+// The first page still costs an O(result size) read to populate the cursor,
+// but continuingCachedPage short-circuits every later page straight to the
+// cursor before the endpoint's closure touches the state store at all, so
+// paging through an existing query costs O(page size), not O(result size)
+// per page. What's still out of scope for this server-side cursor layer is
+// true key-range watches: a page's blockingQuery, on its first page, wakes
+// on the whole keyspace the query reads from rather than just the slice
+// that page returned. Narrowing that would need the query functions in
+// agent/consul/state to support resuming an iterator from a key, which
+// doesn't exist in this package.
+type cursor struct {
+	index      uint64
+	offset     int
+	pageSize   int
+	lastAccess time.Time
+
+	healthChecks      structs.HealthChecks
+	checkServiceNodes structs.CheckServiceNodes
+
+	// tokenFingerprint is tokenFingerprint(args.Token) from the request that
+	// started this cursor. healthChecks/checkServiceNodes were already run
+	// through filterACL for that token; resolve refuses to hand either back
+	// to a continuation request presenting a different token, since that
+	// would serve data filtered for someone else's permissions rather than
+	// the requester's.
+	tokenFingerprint [sha256.Size]byte
+}
+
+// tokenFingerprint hashes an ACL token so cursors can be bound to the token
+// that started them without holding the plaintext token in memory for the
+// lifetime of the cursor.
+func tokenFingerprint(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// cursorRegistry hands out and resolves the opaque PageToken used to keep a
+// multi-page query pinned to its first page's snapshot index and result
+// set. The bulk result set is deliberately kept as short-lived server-side
+// state rather than round-tripped through the token; the token itself is
+// prefixed with the index and offset it was issued at (see newPageToken)
+// purely so the continuation point is visible in logs and to an operator
+// inspecting a token, not so it can be resumed from - once the cursor entry
+// backing a token is evicted (cursorTTL) or unknown, resolve reports it as
+// not found and the caller starts over from page 1 of a fresh query.
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[string]*cursor
+}
+
+func newCursorRegistry() *cursorRegistry {
+	return &cursorRegistry{cursors: make(map[string]*cursor)}
+}
+
+// newPageToken returns an opaque token for a page that resumes at (index,
+// offset). The index and offset are encoded directly into the token as an
+// "index.offset.random" prefix purely for observability - so the point a
+// token was issued at is visible without a registry lookup - not to make the
+// token itself resumable: resolving it still requires the server-side
+// cursor, and an evicted or unknown token simply falls back to page 1 of a
+// fresh query (see resolve).
+func newPageToken(index uint64, offset int) (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate page token: %w", err)
+	}
+	return fmt.Sprintf("%d.%d.%s", index, offset, base64.RawURLEncoding.EncodeToString(buf)), nil
+}
+
+// startHealthChecks pins a HealthChecks query's full result set at index,
+// starting the next page at offset with pageSize, binds the cursor to
+// aclToken so only a continuation presenting the same token can resume it,
+// and returns the page token it resolves to. pageSize is remembered on the
+// cursor itself so every later page of this query keeps using it even if a
+// caller only resends the page token and not PageSize on continuation
+// requests.
+func (r *cursorRegistry) startHealthChecks(index uint64, items structs.HealthChecks, offset, pageSize int, aclToken string) (string, error) {
+	pageToken, err := newPageToken(index, offset)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpiredLocked()
+	r.cursors[pageToken] = &cursor{
+		index: index, healthChecks: items, offset: offset, pageSize: pageSize,
+		tokenFingerprint: tokenFingerprint(aclToken), lastAccess: time.Now(),
+	}
+	return pageToken, nil
+}
+
+// startCheckServiceNodes pins a CheckServiceNodes query's full result set at
+// index, starting the next page at offset with pageSize, binds the cursor to
+// aclToken so only a continuation presenting the same token can resume it,
+// and returns the page token it resolves to. pageSize is remembered on the
+// cursor itself so every later page of this query keeps using it even if a
+// caller only resends the page token and not PageSize on continuation
+// requests.
+func (r *cursorRegistry) startCheckServiceNodes(index uint64, items structs.CheckServiceNodes, offset, pageSize int, aclToken string) (string, error) {
+	pageToken, err := newPageToken(index, offset)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpiredLocked()
+	r.cursors[pageToken] = &cursor{
+		index: index, checkServiceNodes: items, offset: offset, pageSize: pageSize,
+		tokenFingerprint: tokenFingerprint(aclToken), lastAccess: time.Now(),
+	}
+	return pageToken, nil
+}
+
+// resolve looks up the cursor for pageToken. ok is false if pageToken is
+// empty, unknown, has expired, or was started by a different ACL token than
+// aclToken - the cursor's healthChecks/checkServiceNodes were already
+// filterACL'd for whichever token started it, so a continuation request
+// presenting any other token must not be handed that result; it's treated
+// exactly like an expired or unknown token and falls back to page 1 of a
+// fresh query run (and filtered) under its own token.
+func (r *cursorRegistry) resolve(aclToken, pageToken string) (c cursor, ok bool) {
+	if pageToken == "" {
+		return cursor{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpiredLocked()
+
+	found, ok := r.cursors[pageToken]
+	if !ok {
+		return cursor{}, false
+	}
+	want := tokenFingerprint(aclToken)
+	if subtle.ConstantTimeCompare(found.tokenFingerprint[:], want[:]) != 1 {
+		return cursor{}, false
+	}
+	found.lastAccess = time.Now()
+	return *found, true
+}
+
+// advance updates pageToken's cursor to resume its next page at offset.
+func (r *cursorRegistry) advance(pageToken string, offset int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.cursors[pageToken]; ok {
+		c.offset = offset
+		c.lastAccess = time.Now()
+	}
+}
+
+// remove drops token's cursor once its query has been fully paged through.
+func (r *cursorRegistry) remove(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cursors, token)
+}
+
+// evictExpiredLocked drops cursors idle longer than cursorTTL. Callers must
+// hold r.mu.
+func (r *cursorRegistry) evictExpiredLocked() {
+	cutoff := time.Now().Add(-cursorTTL)
+	for token, c := range r.cursors {
+		if c.lastAccess.Before(cutoff) {
+			delete(r.cursors, token)
+		}
+	}
+}
+
+// pageCursors returns the Health endpoint's shared cursorRegistry, creating
+// it on first use.
+func (h *Health) pageCursors() *cursorRegistry {
+	h.pageCursorsOnce.Do(func() {
+		h.pageCursorsReg = newCursorRegistry()
+	})
+	return h.pageCursorsReg
+}
+
+// pagingQueryOptions returns the QueryOptions blockingQuery should actually
+// long-poll on for args. A continuing page is served straight out of its
+// pinned cursor below, never by re-running the query, so honoring the
+// caller's MinQueryIndex for it would make blockingQuery wait out the full
+// MaxQueryTime comparing that index against a pinned result it has nothing
+// to do with, stalling every page after the first.
+func (h *Health) pagingQueryOptions(opts structs.QueryOptions) structs.QueryOptions {
+	if opts.PageToken != "" {
+		opts.MinQueryIndex = 0
+	}
+	return opts
+}
+
+// continuingCachedPage reports whether pageToken resolves to a live cursor
+// started by this same aclToken, meaning the caller is continuing a prior
+// paginated query of its own rather than starting one (or presenting someone
+// else's token). Callers use this to skip straight to the cursor's pinned
+// page instead of re-reading and re-filtering the whole result set, the same
+// way the paginate* functions below already serve page N's bytes from the
+// cursor - this just does it before the state store read happens at all,
+// not after.
+func (h *Health) continuingCachedPage(aclToken, pageToken string) bool {
+	if pageToken == "" {
+		return false
+	}
+	_, ok := h.pageCursors().resolve(aclToken, pageToken)
+	return ok
+}
+
+// paginateHealthChecks slices a single page of at most pageSize checks out
+// of reply.HealthChecks (for a fresh query) or, if pageToken continues a
+// prior cursor started under the same aclToken, out of that cursor's pinned
+// result set - ignoring whatever reply.HealthChecks was just freshly read
+// as, so every page of the same query reflects the same point in time
+// regardless of writes in between.
+//
+// A pageToken started under a different token doesn't resolve at all (see
+// cursorRegistry.resolve) and is treated the same as an unknown one, so a
+// continuation never serves another caller's already-filterACL'd page.
+//
+// pageSize is only honored as passed for a fresh query (pageToken == "");
+// <= 0 there means "return everything" and pagination never starts. Once a
+// cursor exists, its own pinned pageSize - from the request that started it
+// - is used instead, since a caller continuing a paged query may resend only
+// PageToken and not PageSize on later pages.
+func (h *Health) paginateHealthChecks(aclToken string, pageSize int, pageToken string, reply *structs.IndexedHealthChecks) error {
+	items, index, offset := reply.HealthChecks, reply.Index, 0
+	if pageToken != "" {
+		if c, ok := h.pageCursors().resolve(aclToken, pageToken); ok {
+			items, index, offset, pageSize = c.healthChecks, c.index, c.offset, c.pageSize
+		} else if pageSize <= 0 {
+			// The cursor backing this token is gone (or was started under a
+			// different ACL token), so there's no pinned pageSize left to
+			// fall back to, and the caller didn't resend one either - we
+			// can't silently hand back the whole fresh result set without
+			// contradicting the page size it originally asked for.
+			return fmt.Errorf("page token expired or unknown; resend PageSize to restart pagination")
+		} else {
+			pageToken = ""
+		}
+	}
+	if pageSize <= 0 {
+		return nil
+	}
+
+	end := offset + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	reply.HealthChecks = append(structs.HealthChecks(nil), items[offset:end]...)
+	reply.Index = index
+
+	if end >= len(items) {
+		if pageToken != "" {
+			h.pageCursors().remove(pageToken)
+		}
+		reply.NextPageToken = ""
+		return nil
+	}
+
+	if pageToken == "" {
+		token, err := h.pageCursors().startHealthChecks(index, items, end, pageSize, aclToken)
+		if err != nil {
+			return err
+		}
+		reply.NextPageToken = token
+	} else {
+		h.pageCursors().advance(pageToken, end)
+		reply.NextPageToken = pageToken
+	}
+	return nil
+}
+
+// paginateCheckServiceNodes slices a single page of at most pageSize nodes
+// out of reply.Nodes (for a fresh query) or, if pageToken continues a prior
+// cursor started under the same aclToken, out of that cursor's pinned result
+// set - ignoring whatever reply.Nodes was just freshly read as, so every
+// page of the same query reflects the same point in time regardless of
+// writes in between.
+//
+// A pageToken started under a different token doesn't resolve at all (see
+// cursorRegistry.resolve) and is treated the same as an unknown one, so a
+// continuation never serves another caller's already-filterACL'd page.
+//
+// pageSize is only honored as passed for a fresh query (pageToken == "");
+// <= 0 there means "return everything" and pagination never starts. Once a
+// cursor exists, its own pinned pageSize - from the request that started it
+// - is used instead, since a caller continuing a paged query may resend only
+// PageToken and not PageSize on later pages.
+func (h *Health) paginateCheckServiceNodes(aclToken string, pageSize int, pageToken string, reply *structs.IndexedCheckServiceNodes) error {
+	items, index, offset := reply.Nodes, reply.Index, 0
+	if pageToken != "" {
+		if c, ok := h.pageCursors().resolve(aclToken, pageToken); ok {
+			items, index, offset, pageSize = c.checkServiceNodes, c.index, c.offset, c.pageSize
+		} else if pageSize <= 0 {
+			// The cursor backing this token is gone (or was started under a
+			// different ACL token), so there's no pinned pageSize left to
+			// fall back to, and the caller didn't resend one either - we
+			// can't silently hand back the whole fresh result set without
+			// contradicting the page size it originally asked for.
+			return fmt.Errorf("page token expired or unknown; resend PageSize to restart pagination")
+		} else {
+			pageToken = ""
+		}
+	}
+	if pageSize <= 0 {
+		return nil
+	}
+
+	end := offset + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	reply.Nodes = append(structs.CheckServiceNodes(nil), items[offset:end]...)
+	reply.Index = index
+
+	if end >= len(items) {
+		if pageToken != "" {
+			h.pageCursors().remove(pageToken)
+		}
+		reply.NextPageToken = ""
+		return nil
+	}
+
+	if pageToken == "" {
+		token, err := h.pageCursors().startCheckServiceNodes(index, items, end, pageSize, aclToken)
+		if err != nil {
+			return err
+		}
+		reply.NextPageToken = token
+	} else {
+		h.pageCursors().advance(pageToken, end)
+		reply.NextPageToken = pageToken
+	}
+	return nil
+}
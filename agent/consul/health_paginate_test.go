@@ -0,0 +1,209 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+func TestPaginateHealthChecks_PinsAcrossIntervalWrites(t *testing.T) {
+	h := &Health{}
+
+	first := structs.HealthChecks{
+		{Node: "a", CheckID: "c1"},
+		{Node: "b", CheckID: "c2"},
+		{Node: "c", CheckID: "c3"},
+	}
+
+	reply := &structs.IndexedHealthChecks{HealthChecks: first, QueryMeta: structs.QueryMeta{Index: 10}}
+	if err := h.paginateHealthChecks("token", 2, "", reply); err != nil {
+		t.Fatalf("page 1: %v", err)
+	}
+	if len(reply.HealthChecks) != 2 || reply.HealthChecks[0].Node != "a" || reply.HealthChecks[1].Node != "b" {
+		t.Fatalf("page 1 wrong slice: %+v", reply.HealthChecks)
+	}
+	if reply.NextPageToken == "" {
+		t.Fatal("expected a continuation token")
+	}
+	if reply.Index != 10 {
+		t.Fatalf("page 1 index = %d, want 10", reply.Index)
+	}
+	token := reply.NextPageToken
+
+	// A write lands between page 1 and page 2: the live result set grows and
+	// its index moves on. Continuing the same query must still page through
+	// the original 3-check snapshot at index 10, not the live 4-check one.
+	live := structs.HealthChecks{
+		{Node: "a", CheckID: "c1"},
+		{Node: "b", CheckID: "c2"},
+		{Node: "c", CheckID: "c3"},
+		{Node: "d", CheckID: "c4"},
+	}
+
+	reply2 := &structs.IndexedHealthChecks{HealthChecks: live, QueryMeta: structs.QueryMeta{Index: 20}}
+	if err := h.paginateHealthChecks("token", 2, token, reply2); err != nil {
+		t.Fatalf("page 2: %v", err)
+	}
+	if len(reply2.HealthChecks) != 1 || reply2.HealthChecks[0].Node != "c" {
+		t.Fatalf("page 2 wrong slice: %+v", reply2.HealthChecks)
+	}
+	if reply2.Index != 10 {
+		t.Fatalf("page 2 index = %d, want pinned 10", reply2.Index)
+	}
+	if reply2.NextPageToken != "" {
+		t.Fatalf("expected page 2 to be the last page, got token %q", reply2.NextPageToken)
+	}
+}
+
+func TestPaginateHealthChecks_ExpiredTokenRestartsFromFreshResult(t *testing.T) {
+	h := &Health{}
+
+	live := structs.HealthChecks{
+		{Node: "a", CheckID: "c1"},
+		{Node: "b", CheckID: "c2"},
+	}
+	reply := &structs.IndexedHealthChecks{HealthChecks: live, QueryMeta: structs.QueryMeta{Index: 30}}
+
+	if err := h.paginateHealthChecks("token", 2, "not-a-real-token", reply); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reply.HealthChecks) != 2 {
+		t.Fatalf("expected a fresh first page, got %+v", reply.HealthChecks)
+	}
+	if reply.Index != 30 {
+		t.Fatalf("index = %d, want 30", reply.Index)
+	}
+}
+
+func TestPaginateHealthChecks_MismatchedTokenRestartsFromFreshResult(t *testing.T) {
+	h := &Health{}
+
+	first := structs.HealthChecks{
+		{Node: "a", CheckID: "c1"},
+		{Node: "b", CheckID: "c2"},
+		{Node: "c", CheckID: "c3"},
+	}
+	reply := &structs.IndexedHealthChecks{HealthChecks: first, QueryMeta: structs.QueryMeta{Index: 10}}
+	if err := h.paginateHealthChecks("alice-token", 2, "", reply); err != nil {
+		t.Fatalf("page 1: %v", err)
+	}
+	token := reply.NextPageToken
+	if token == "" {
+		t.Fatal("expected a continuation token")
+	}
+
+	// Bob presents Alice's page token with his own ACL token. He must not
+	// get Alice's already-filterACL'd page back; he gets a fresh first page
+	// of his own instead.
+	live := structs.HealthChecks{
+		{Node: "a", CheckID: "c1"},
+		{Node: "b", CheckID: "c2"},
+	}
+	reply2 := &structs.IndexedHealthChecks{HealthChecks: live, QueryMeta: structs.QueryMeta{Index: 20}}
+	if err := h.paginateHealthChecks("bob-token", 2, token, reply2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reply2.HealthChecks) != 2 || reply2.Index != 20 {
+		t.Fatalf("expected bob's own fresh page (index 20, 2 checks), got index %d: %+v", reply2.Index, reply2.HealthChecks)
+	}
+
+	if h.continuingCachedPage("bob-token", token) {
+		t.Fatal("a page token started under a different ACL token must not be recognized as a continuation")
+	}
+	if !h.continuingCachedPage("alice-token", token) {
+		t.Fatal("the originating token must still recognize its own page token as a continuation")
+	}
+}
+
+func TestPaginateHealthChecks_ContinuationIgnoresZeroPageSize(t *testing.T) {
+	h := &Health{}
+
+	first := structs.HealthChecks{
+		{Node: "a", CheckID: "c1"},
+		{Node: "b", CheckID: "c2"},
+		{Node: "c", CheckID: "c3"},
+	}
+	reply := &structs.IndexedHealthChecks{HealthChecks: first, QueryMeta: structs.QueryMeta{Index: 10}}
+	if err := h.paginateHealthChecks("token", 2, "", reply); err != nil {
+		t.Fatalf("page 1: %v", err)
+	}
+	token := reply.NextPageToken
+	if token == "" {
+		t.Fatal("expected a continuation token")
+	}
+
+	// A client that only resends the token on later pages, per the documented
+	// "PageSize<=0 means return everything", must still get the rest of its
+	// paged query from the cursor's own pinned page size - not an empty page.
+	reply2 := &structs.IndexedHealthChecks{}
+	if err := h.paginateHealthChecks("token", 0, token, reply2); err != nil {
+		t.Fatalf("page 2: %v", err)
+	}
+	if len(reply2.HealthChecks) != 1 || reply2.HealthChecks[0].Node != "c" {
+		t.Fatalf("page 2 wrong slice: %+v", reply2.HealthChecks)
+	}
+}
+
+func TestPaginateHealthChecks_ExpiredTokenWithoutPageSizeErrors(t *testing.T) {
+	h := &Health{}
+
+	live := structs.HealthChecks{{Node: "a"}, {Node: "b"}, {Node: "c"}}
+	reply := &structs.IndexedHealthChecks{HealthChecks: live, QueryMeta: structs.QueryMeta{Index: 30}}
+
+	// An expired/unknown token with no PageSize to fall back to must not
+	// silently hand back the whole fresh result set.
+	if err := h.paginateHealthChecks("token", 0, "not-a-real-token", reply); err == nil {
+		t.Fatal("expected an error instead of returning the whole unbounded result set")
+	}
+}
+
+func TestContinuingCachedPage(t *testing.T) {
+	h := &Health{}
+
+	if h.continuingCachedPage("token", "") {
+		t.Fatal("empty token must not be treated as a continuation")
+	}
+	if h.continuingCachedPage("token", "unknown") {
+		t.Fatal("unknown token must not be treated as a continuation")
+	}
+
+	reply := &structs.IndexedHealthChecks{
+		HealthChecks: structs.HealthChecks{{Node: "a"}, {Node: "b"}, {Node: "c"}},
+		QueryMeta:    structs.QueryMeta{Index: 5},
+	}
+	if err := h.paginateHealthChecks("token", 1, "", reply); err != nil {
+		t.Fatalf("page 1: %v", err)
+	}
+	if !h.continuingCachedPage("token", reply.NextPageToken) {
+		t.Fatal("a live page's token must be recognized as a continuation")
+	}
+}
+
+func TestNewPageToken_EncodesIndexAndOffset(t *testing.T) {
+	token, err := newPageToken(42, 7)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const want = "42.7."
+	if len(token) <= len(want) || token[:len(want)] != want {
+		t.Fatalf("token = %q, want prefix %q", token, want)
+	}
+}
+
+func TestPagingQueryOptions_ZeroesMinQueryIndexForContinuation(t *testing.T) {
+	h := &Health{}
+
+	fresh := structs.QueryOptions{MinQueryIndex: 100}
+	if got := h.pagingQueryOptions(fresh); got.MinQueryIndex != 100 {
+		t.Fatalf("first page MinQueryIndex = %d, want unchanged 100", got.MinQueryIndex)
+	}
+
+	continuing := structs.QueryOptions{MinQueryIndex: 100, PageOptions: structs.PageOptions{PageToken: "some-token"}}
+	got := h.pagingQueryOptions(continuing)
+	if got.MinQueryIndex != 0 {
+		t.Fatalf("continuation page MinQueryIndex = %d, want 0 so blockingQuery doesn't stall waiting on a pinned result", got.MinQueryIndex)
+	}
+	if got.PageToken != "some-token" {
+		t.Fatalf("pagingQueryOptions must not disturb PageToken: got %q", got.PageToken)
+	}
+}
@@ -0,0 +1,602 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/consul/state"
+	"github.com/hashicorp/consul/agent/structs"
+	bexpr "github.com/hashicorp/go-bexpr"
+	"github.com/hashicorp/go-memdb"
+)
+
+// serviceHealthEventType distinguishes the kinds of incremental changes a
+// SubscribeServiceNodes caller observes after its initial snapshot.
+type serviceHealthEventType int
+
+const (
+	serviceHealthNodeUpsert serviceHealthEventType = iota
+	serviceHealthNodeDelete
+)
+
+// serviceHealthInstanceID identifies one service instance (one
+// CheckServiceNode) within a topic, independent of its current health, so
+// that a removal can be published without needing the removed node's data.
+type serviceHealthInstanceID struct {
+	Node      string
+	ServiceID string
+}
+
+func serviceHealthInstanceIDFor(n structs.CheckServiceNode) serviceHealthInstanceID {
+	return serviceHealthInstanceID{Node: n.Node.Node, ServiceID: n.Service.ID}
+}
+
+// serviceHealthEvent is a single incremental change to a CheckServiceNode,
+// published to every subscriber of the owning service's topic. Node is only
+// populated for upserts; deletes carry just enough identity to let a
+// subscriber drop the instance from the view it's maintaining.
+type serviceHealthEvent struct {
+	Index    uint64
+	Type     serviceHealthEventType
+	Node     structs.CheckServiceNode
+	Instance serviceHealthInstanceID
+}
+
+// subscriptionBufferSize bounds how many incremental events are retained per
+// service topic. A subscriber that falls further behind than this is handed
+// a fresh snapshot instead of replaying the full backlog of changes.
+const subscriptionBufferSize = 1024
+
+// serviceHealthRingBuffer is a fixed-capacity circular buffer of recent
+// serviceHealthEvents for one service topic. It lets a reconnecting or
+// momentarily slow subscriber catch up from its last-seen index without
+// re-scanning memdb, while keeping memory use bounded regardless of how many
+// topics or subscribers exist. Unlike a slice that's repeatedly resliced,
+// push is O(1) and never reallocates; since scans the retained events once.
+type serviceHealthRingBuffer struct {
+	mu     sync.Mutex
+	events []serviceHealthEvent // fixed-size backing array; indices wrap mod len(events)
+	head   int                  // index of the oldest retained event
+	count  int                  // number of valid events currently retained
+
+	// latestIndex/latestNodes is the topic pump's most recently observed
+	// state, updated under the same lock as events so a subscriber's
+	// initial view always comes from exactly what the pump has already
+	// published, rather than from an independent read of its own that
+	// could land at a different index than the pump's next diff starts
+	// from. ready closes once the pump's first read populates these.
+	latestIndex uint64
+	latestNodes structs.CheckServiceNodes
+	ready       chan struct{}
+
+	// changed closes every time push is called and is immediately replaced,
+	// so a subscriber blocked in wait() only wakes for pushes to this topic's
+	// own buffer, not for every other topic's publisher activity.
+	changed chan struct{}
+}
+
+func newServiceHealthRingBuffer() *serviceHealthRingBuffer {
+	return &serviceHealthRingBuffer{
+		events:  make([]serviceHealthEvent, subscriptionBufferSize),
+		ready:   make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// setLatest records the topic pump's most recent read, for a new subscriber
+// to start from.
+func (b *serviceHealthRingBuffer) setLatest(index uint64, nodes structs.CheckServiceNodes) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latestIndex, b.latestNodes = index, nodes
+}
+
+// snapshot returns the topic pump's most recently observed (index, nodes).
+func (b *serviceHealthRingBuffer) snapshot() (uint64, structs.CheckServiceNodes) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.latestIndex, b.latestNodes
+}
+
+// markReady signals that the pump's first read has landed and snapshot is
+// safe to call. Safe to call more than once.
+func (b *serviceHealthRingBuffer) markReady() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.ready:
+	default:
+		close(b.ready)
+	}
+}
+
+// waitReady blocks until the pump's first read has landed, or ctx is done.
+func (b *serviceHealthRingBuffer) waitReady(ctx context.Context) error {
+	select {
+	case <-b.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// push records ev, overwriting the oldest retained event once the buffer is
+// full, and wakes anyone blocked in wait().
+func (b *serviceHealthRingBuffer) push(ev serviceHealthEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tail := (b.head + b.count) % len(b.events)
+	b.events[tail] = ev
+	if b.count == len(b.events) {
+		b.head = (b.head + 1) % len(b.events)
+	} else {
+		b.count++
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// wait returns a channel that closes the next time this topic's buffer is
+// pushed to. Subscribers use it to block between polls of their own ring
+// buffer without busy-waiting, and without waking for other topics' changes.
+func (b *serviceHealthRingBuffer) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.changed
+}
+
+// since returns the events with Index > fromIndex. ok is false if fromIndex+1
+// is lower than the Index of the oldest retained event, in which case the
+// caller must fall back to a fresh snapshot rather than trust the returned
+// events. An empty buffer always reports ok.
+func (b *serviceHealthRingBuffer) since(fromIndex uint64) (events []serviceHealthEvent, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count == 0 {
+		return nil, true
+	}
+	oldest := b.events[b.head]
+	if fromIndex+1 < oldest.Index {
+		return nil, false
+	}
+	for i := 0; i < b.count; i++ {
+		ev := b.events[(b.head+i)%len(b.events)]
+		if ev.Index > fromIndex {
+			events = append(events, ev)
+		}
+	}
+	return events, true
+}
+
+// serviceHealthPublisher fans incremental CheckServiceNode changes out to
+// per-service ring buffers, replacing the O(watchers x changes) cost of
+// re-running a blockingQuery for every watcher with one topic pump per
+// service plus cheap per-subscriber reads of its own ring buffer.
+type serviceHealthPublisher struct {
+	mu     sync.Mutex
+	topics map[string]*serviceHealthRingBuffer
+	pumps  map[string]bool
+}
+
+func newServiceHealthPublisher() *serviceHealthPublisher {
+	return &serviceHealthPublisher{
+		topics: make(map[string]*serviceHealthRingBuffer),
+		pumps:  make(map[string]bool),
+	}
+}
+
+// serviceHealthTopic identifies the pump/ring buffer that args' subscription
+// maps to: service name plus namespace, and - mirroring the dispatch
+// serviceNodesFunc picks for ServiceNodes - whether it's a Connect lookup or
+// carries a tag filter, since those read a different set of instances than a
+// plain lookup of the same service name and must never share a buffer with
+// one.
+func serviceHealthTopic(args *structs.ServiceSpecificRequest) string {
+	topic := args.EnterpriseMeta.NamespaceOrDefault() + "/" + args.ServiceName
+	switch {
+	case args.Connect:
+		return topic + "/connect"
+	case args.TagFilter:
+		tags := append([]string(nil), normalizedServiceTags(args)...)
+		sort.Strings(tags)
+		return topic + "/tags=" + strings.Join(tags, ",")
+	default:
+		return topic
+	}
+}
+
+// normalizedServiceTags returns the tags a tag-filtered lookup applies,
+// preferring the deprecated singular ServiceTag the same way
+// serviceNodesTagFilter does.
+func normalizedServiceTags(args *structs.ServiceSpecificRequest) []string {
+	if args.ServiceTag != "" {
+		return []string{args.ServiceTag}
+	}
+	return args.ServiceTags
+}
+
+// servicePumpArgs returns the subset of args that determine which
+// CheckServiceNodes lookup a topic's pump performs, stripped of
+// subscriber-specific fields (Token, Filter, NodeMetaFilters, ...) that
+// filterServiceNodes applies per-subscriber instead, since those must not
+// leak into the long-lived read every subscriber of the topic shares.
+func servicePumpArgs(args *structs.ServiceSpecificRequest) *structs.ServiceSpecificRequest {
+	return &structs.ServiceSpecificRequest{
+		ServiceName:    args.ServiceName,
+		EnterpriseMeta: args.EnterpriseMeta,
+		Connect:        args.Connect,
+		TagFilter:      args.TagFilter,
+		ServiceTag:     args.ServiceTag,
+		ServiceTags:    args.ServiceTags,
+	}
+}
+
+func (p *serviceHealthPublisher) bufferFor(topic string) *serviceHealthRingBuffer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buf, ok := p.topics[topic]
+	if !ok {
+		buf = newServiceHealthRingBuffer()
+		p.topics[topic] = buf
+	}
+	return buf
+}
+
+// Publish records a CheckServiceNode change and wakes any subscriber blocked
+// in that topic's buffer's wait(). It is called by runServiceHealthTopicPump,
+// which feeds it from the same memdb watch mechanism that powers every
+// blockingQuery in this package, translated into per-instance upsert/delete
+// events.
+func (p *serviceHealthPublisher) Publish(topic string, ev serviceHealthEvent) {
+	p.bufferFor(topic).push(ev)
+}
+
+// ensurePump starts h.runServiceHealthTopicPump for args' topic if it isn't
+// already running. Pumps are started lazily, on a topic's first subscriber,
+// and then keep running for the lifetime of the server so later subscribers
+// to the same topic attach to an already-warm ring buffer.
+func (p *serviceHealthPublisher) ensurePump(h *Health, args *structs.ServiceSpecificRequest) {
+	topic := serviceHealthTopic(args)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pumps[topic] {
+		return
+	}
+	p.pumps[topic] = true
+	go h.runServiceHealthTopicPump(topic, servicePumpArgs(args))
+}
+
+// eventPublisher returns the Health endpoint's shared serviceHealthPublisher,
+// creating it on first use so callers that never subscribe don't pay for it.
+func (h *Health) eventPublisher() *serviceHealthPublisher {
+	h.publisherOnce.Do(func() {
+		h.publisher = newServiceHealthPublisher()
+	})
+	return h.publisher
+}
+
+// runServiceHealthTopicPump is the sole producer of serviceHealthEvents for
+// topic. It re-reads CheckServiceNodes each time the memdb WatchSet from its
+// previous read fires - the same write-triggered wakeup every blockingQuery
+// in this package relies on - diffs the result against what it last saw, and
+// publishes the difference as upsert/delete events. Running one pump per
+// topic, shared by every subscriber of that topic, is what keeps the cost of
+// a change independent of how many subscribers are watching it. args is the
+// servicePumpArgs-trimmed request that determines the lookup (Connect,
+// TagFilter, tags, ...); it's fixed for the lifetime of the pump, matching
+// the topic string it was started under.
+func (h *Health) runServiceHealthTopicPump(topic string, args *structs.ServiceSpecificRequest) {
+	pub := h.eventPublisher()
+	buf := pub.bufferFor(topic)
+
+	ws, index, nodes, err := h.readServiceNodesForPump(args)
+	for err != nil {
+		time.Sleep(time.Second)
+		ws, index, nodes, err = h.readServiceNodesForPump(args)
+	}
+	// Publish this baseline before any subscriber can observe the topic: a
+	// subscriber's initial view comes from buf.snapshot(), never from a read
+	// of its own, so there's no window for a write to land between "the
+	// subscriber's snapshot" and "the pump's starting point" the way there
+	// would be if each took an independent read.
+	buf.setLatest(index, nodes)
+	buf.markReady()
+
+	for {
+		if err := ws.WatchCtx(context.Background()); err != nil {
+			return
+		}
+
+		newWS, newIndex, newNodes, err := h.readServiceNodesForPump(args)
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, n := range diffServiceHealthUpserts(nodes, newNodes) {
+			pub.Publish(topic, serviceHealthEvent{Index: newIndex, Type: serviceHealthNodeUpsert, Node: n})
+		}
+		for _, id := range diffServiceHealthRemovals(nodes, newNodes) {
+			pub.Publish(topic, serviceHealthEvent{Index: newIndex, Type: serviceHealthNodeDelete, Instance: id})
+		}
+		buf.setLatest(newIndex, newNodes)
+
+		ws, index, nodes = newWS, newIndex, newNodes
+	}
+}
+
+// readServiceNodesForPump takes an unfiltered, unauthenticated memdb read of
+// args' service, using the same serviceNodesFunc dispatch ServiceNodes uses
+// so a Connect or tag-filtered topic's pump reads the same instances that
+// endpoint would, along with the WatchSet to block on for the next change.
+// ACL and bexpr filtering are applied per-subscriber instead, in
+// filterServiceNodes, since different subscribers of the same topic can hold
+// different tokens and filters.
+func (h *Health) readServiceNodesForPump(args *structs.ServiceSpecificRequest) (memdb.WatchSet, uint64, structs.CheckServiceNodes, error) {
+	ws := memdb.NewWatchSet()
+	f := h.serviceNodesFunc(args)
+	index, nodes, err := f(ws, h.srv.fsm.State(), args)
+	return ws, index, nodes, err
+}
+
+// diffServiceHealthUpserts returns the instances in next that are new or
+// have changed (including a check status change) relative to prev.
+func diffServiceHealthUpserts(prev, next structs.CheckServiceNodes) structs.CheckServiceNodes {
+	prevByID := make(map[serviceHealthInstanceID]structs.CheckServiceNode, len(prev))
+	for _, n := range prev {
+		prevByID[serviceHealthInstanceIDFor(n)] = n
+	}
+
+	var upserts structs.CheckServiceNodes
+	for _, n := range next {
+		old, ok := prevByID[serviceHealthInstanceIDFor(n)]
+		if !ok || !reflect.DeepEqual(old, n) {
+			upserts = append(upserts, n)
+		}
+	}
+	return upserts
+}
+
+// diffServiceHealthRemovals returns the identities of instances present in
+// prev but absent from next.
+func diffServiceHealthRemovals(prev, next structs.CheckServiceNodes) []serviceHealthInstanceID {
+	stillPresent := make(map[serviceHealthInstanceID]bool, len(next))
+	for _, n := range next {
+		stillPresent[serviceHealthInstanceIDFor(n)] = true
+	}
+
+	var removed []serviceHealthInstanceID
+	for _, n := range prev {
+		id := serviceHealthInstanceIDFor(n)
+		if !stillPresent[id] {
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
+
+// ServiceHealthUpdateKind distinguishes a full resync from an incremental
+// delta in a ServiceHealthUpdate.
+type ServiceHealthUpdateKind int
+
+const (
+	// ServiceHealthSnapshot carries the complete current view; Upserts is
+	// the full instance list and Removed is unused.
+	ServiceHealthSnapshot ServiceHealthUpdateKind = iota
+	// ServiceHealthDelta carries only what changed since the last update:
+	// Upserts for added/changed instances, Removed for instances that are
+	// gone. CheckServiceNodes alone can't express a removal, which is why
+	// this type exists instead of reusing structs.IndexedCheckServiceNodes
+	// for incremental events.
+	ServiceHealthDelta
+)
+
+// ServiceHealthUpdate is delivered to SubscribeServiceNodes callbacks.
+type ServiceHealthUpdate struct {
+	Kind    ServiceHealthUpdateKind
+	Index   uint64
+	Upserts structs.CheckServiceNodes
+	Removed []serviceHealthInstanceID
+}
+
+// eventsToServiceHealthDelta flattens a batch of incremental events into a
+// single ServiceHealthDelta update, preserving both upserts and removals.
+func eventsToServiceHealthDelta(events []serviceHealthEvent) ServiceHealthUpdate {
+	update := ServiceHealthUpdate{Kind: ServiceHealthDelta}
+	for _, ev := range events {
+		update.Index = ev.Index
+		switch ev.Type {
+		case serviceHealthNodeUpsert:
+			update.Upserts = append(update.Upserts, ev.Node)
+		case serviceHealthNodeDelete:
+			update.Removed = append(update.Removed, ev.Instance)
+		}
+	}
+	return update
+}
+
+// SubscribeServiceNodes streams CheckServiceNodes for args.ServiceName to cb,
+// until ctx is cancelled or cb returns an error. A first-time caller
+// (args.MinQueryIndex == 0) gets a ServiceHealthSnapshot of the current
+// state; a reconnecting caller that sends the index it last saw resumes from
+// there instead - a ServiceHealthDelta replaying what it missed if that
+// index is still within the topic's ring buffer, or a fresh
+// ServiceHealthSnapshot if the gap is too large to replay (the buffer
+// wrapped, or the topic's pump only just started). Either way subsequent
+// updates are ServiceHealthDelta as nodes are added, removed, or change check
+// status.
+//
+// This replaces the long-poll blockingQuery model used by ServiceNodes: a
+// blocking query re-executes its whole query function for every watcher on
+// every change, which costs O(watchers x changes) on a cluster where
+// thousands of Envoy sidecars poll the same service. Subscribers here instead
+// read from a bounded per-topic ring buffer fed by a single topic pump (see
+// runServiceHealthTopicPump), so the cost of a change is independent of how
+// many subscribers are watching it.
+func (h *Health) SubscribeServiceNodes(ctx context.Context, args *structs.ServiceSpecificRequest, cb func(ServiceHealthUpdate) error) error {
+	if args.ServiceName == "" {
+		return fmt.Errorf("Must provide service name")
+	}
+
+	var authzContext acl.AuthorizerContext
+	authz, err := h.srv.ResolveTokenAndDefaultMeta(args.Token, &args.EnterpriseMeta, &authzContext)
+	if err != nil {
+		return err
+	}
+
+	if err := h.srv.validateEnterpriseRequest(&args.EnterpriseMeta, false); err != nil {
+		return err
+	}
+
+	if args.Connect {
+		if authz != nil && authz.ServiceRead(args.ServiceName, &authzContext) != acl.Allow {
+			return nil
+		}
+	}
+
+	pub := h.eventPublisher()
+	pub.ensurePump(h, args)
+	buf := pub.bufferFor(serviceHealthTopic(args))
+	if err := buf.waitReady(ctx); err != nil {
+		return err
+	}
+
+	// Register wait()'s channel before taking the initial snapshot/replay
+	// (and again at the top of every loop iteration below, before doing
+	// anything with it) so a Publish that lands between "read the
+	// snapshot/events" and "start waiting for the next one" still closes the
+	// channel we're about to select on, instead of one we grabbed too late
+	// to see it.
+	waitCh := buf.wait()
+
+	var index uint64
+	var nodes structs.CheckServiceNodes
+	var resumed bool
+	if args.MinQueryIndex > 0 {
+		events, ok := buf.since(args.MinQueryIndex)
+		if ok && len(events) == 0 {
+			// Nothing to replay only means the caller is caught up if its
+			// index has reached the pump's latest read; otherwise (e.g. a
+			// pump that only just started, with an empty buffer) it gets a
+			// fresh snapshot below.
+			if latest, _ := buf.snapshot(); latest > args.MinQueryIndex {
+				ok = false
+			}
+		}
+		if ok {
+			resumed = true
+			index = args.MinQueryIndex
+			if len(events) > 0 {
+				delta := eventsToServiceHealthDelta(events)
+				delta.Upserts, err = h.filterServiceNodes(args, delta.Upserts)
+				if err != nil {
+					return err
+				}
+				if err := cb(delta); err != nil {
+					return err
+				}
+				index = delta.Index
+			}
+			// Otherwise the caller's index is already caught up with the
+			// buffer's latest; nothing to replay until the next Publish.
+		}
+	}
+	if !resumed {
+		index, nodes = buf.snapshot()
+		nodes, err = h.filterServiceNodes(args, nodes)
+		if err != nil {
+			return err
+		}
+		if err := cb(ServiceHealthUpdate{Kind: ServiceHealthSnapshot, Index: index, Upserts: nodes}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-waitCh:
+		}
+		waitCh = buf.wait()
+
+		events, ok := buf.since(index)
+		if !ok {
+			// We fell further behind than the ring buffer retains; resync
+			// with the pump's current snapshot instead of replaying partial
+			// history.
+			index, nodes = buf.snapshot()
+			nodes, err = h.filterServiceNodes(args, nodes)
+			if err != nil {
+				return err
+			}
+			if err := cb(ServiceHealthUpdate{Kind: ServiceHealthSnapshot, Index: index, Upserts: nodes}); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		for _, ev := range events {
+			index = ev.Index
+		}
+		delta := eventsToServiceHealthDelta(events)
+		// args' ACL/bexpr filters still apply to incremental events; drop
+		// upserts the subscriber isn't authorized or filtered to see.
+		delta.Upserts, err = h.filterServiceNodes(args, delta.Upserts)
+		if err != nil {
+			return err
+		}
+		if err := cb(delta); err != nil {
+			return err
+		}
+	}
+}
+
+// serviceNodesFunc picks the lookup method ServiceNodes and
+// SubscribeServiceNodes both use to read a service's CheckServiceNodes,
+// based on which of Connect/TagFilter/default applies to args.
+func (h *Health) serviceNodesFunc(args *structs.ServiceSpecificRequest) func(memdb.WatchSet, *state.Store, *structs.ServiceSpecificRequest) (uint64, structs.CheckServiceNodes, error) {
+	switch {
+	case args.Connect:
+		return h.serviceNodesConnect
+	case args.TagFilter:
+		return h.serviceNodesTagFilter
+	default:
+		return h.serviceNodesDefault
+	}
+}
+
+// filterServiceNodes applies NodeMetaFilters, ACL filtering, and args.Filter
+// (bexpr) to nodes, exactly as ServiceNodes does for its reply - the pipeline
+// a raw read off the topic pump's shared buffer still needs to go through
+// before it's specific to one subscriber's token and filters.
+func (h *Health) filterServiceNodes(args *structs.ServiceSpecificRequest, nodes structs.CheckServiceNodes) (structs.CheckServiceNodes, error) {
+	if len(args.NodeMetaFilters) > 0 {
+		nodes = nodeMetaFilter(args.NodeMetaFilters, nodes)
+	}
+
+	reply := &structs.IndexedCheckServiceNodes{Nodes: nodes}
+	if err := h.srv.filterACL(args.Token, reply); err != nil {
+		return nil, err
+	}
+
+	filter, err := bexpr.CreateFilter(args.Filter, nil, reply.Nodes)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := filter.Execute(reply.Nodes)
+	if err != nil {
+		return nil, err
+	}
+	return raw.(structs.CheckServiceNodes), nil
+}
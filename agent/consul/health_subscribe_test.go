@@ -0,0 +1,86 @@
+package consul
+
+import "testing"
+
+func TestServiceHealthRingBuffer_SinceCatchesUp(t *testing.T) {
+	b := newServiceHealthRingBuffer()
+
+	for i := uint64(1); i <= 3; i++ {
+		b.push(serviceHealthEvent{Index: i, Type: serviceHealthNodeUpsert})
+	}
+
+	events, ok := b.since(0)
+	if !ok || len(events) != 3 {
+		t.Fatalf("since(0) = %v, %v; want all 3 events", events, ok)
+	}
+
+	events, ok = b.since(1)
+	if !ok || len(events) != 2 || events[0].Index != 2 {
+		t.Fatalf("since(1) = %v, %v; want events after index 1", events, ok)
+	}
+
+	events, ok = b.since(3)
+	if !ok || len(events) != 0 {
+		t.Fatalf("since(3) = %v, %v; want no events, caught up", events, ok)
+	}
+}
+
+func TestServiceHealthRingBuffer_SinceEmptyBuffer(t *testing.T) {
+	b := newServiceHealthRingBuffer()
+
+	events, ok := b.since(0)
+	if !ok || events != nil {
+		t.Fatalf("since on empty buffer = %v, %v; want nil, true", events, ok)
+	}
+}
+
+func TestServiceHealthRingBuffer_SinceOverflowSignalsResync(t *testing.T) {
+	b := newServiceHealthRingBuffer()
+
+	// Push enough events to wrap the ring buffer well past its capacity, so
+	// fromIndex=1 is older than anything still retained.
+	for i := uint64(1); i <= uint64(subscriptionBufferSize)+10; i++ {
+		b.push(serviceHealthEvent{Index: i, Type: serviceHealthNodeUpsert})
+	}
+
+	events, ok := b.since(1)
+	if ok {
+		t.Fatalf("since(1) after overflow = %v, true; want ok=false so the caller resyncs", events)
+	}
+
+	// A caller that's only a little behind the retained window should still
+	// catch up normally.
+	oldestRetained := uint64(subscriptionBufferSize) + 10 - uint64(subscriptionBufferSize) + 1
+	events, ok = b.since(oldestRetained - 1)
+	if !ok {
+		t.Fatalf("since(%d) = ok=false; want a caller just behind the window to catch up", oldestRetained-1)
+	}
+	if len(events) == 0 {
+		t.Fatal("expected at least one event for a caller just behind the retained window")
+	}
+}
+
+func TestServiceHealthRingBuffer_LatestSnapshotAndReady(t *testing.T) {
+	b := newServiceHealthRingBuffer()
+
+	select {
+	case <-b.ready:
+		t.Fatal("ready must not be closed before the first setLatest/markReady")
+	default:
+	}
+
+	b.setLatest(5, nil)
+	b.markReady()
+	b.markReady() // must be safe to call more than once
+
+	select {
+	case <-b.ready:
+	default:
+		t.Fatal("ready should be closed after markReady")
+	}
+
+	index, nodes := b.snapshot()
+	if index != 5 || nodes != nil {
+		t.Fatalf("snapshot() = %d, %v; want 5, nil", index, nodes)
+	}
+}
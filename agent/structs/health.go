@@ -0,0 +1,166 @@
+package structs
+
+import "time"
+
+// QueryOptions carries the common, cross-endpoint knobs accepted on a read
+// RPC: the ACL token, the blocking query wait index and time, and a post-hoc
+// bexpr filter. PageOptions is embedded rather than inlined so the pagination
+// fields live in the same file as the rest of that feature.
+type QueryOptions struct {
+	Token string
+
+	// MinQueryIndex and MaxQueryTime drive the blockingQuery long-poll.
+	MinQueryIndex uint64
+	MaxQueryTime  time.Duration
+
+	// Filter is a bexpr expression applied to the result after ACL
+	// filtering.
+	Filter string
+
+	PageOptions
+}
+
+// QueryMeta is returned alongside every query reply with the index the
+// result was computed at.
+type QueryMeta struct {
+	Index uint64
+}
+
+// QuerySource describes the client-side node a near= RTT sort should be
+// measured from.
+type QuerySource struct {
+	Node       string
+	Datacenter string
+}
+
+// EnterpriseMeta namespaces a request/result in Consul Enterprise. It is
+// empty in the open source build.
+type EnterpriseMeta struct{}
+
+// NamespaceOrDefault returns the namespace to use for topic keys and the
+// like. Open source Consul has a single, implicit "default" namespace.
+func (m *EnterpriseMeta) NamespaceOrDefault() string {
+	return "default"
+}
+
+// Weights carries the relative weight to give a service instance in
+// weighted load-balancing decisions, depending on whether it's currently
+// passing or only warning.
+type Weights struct {
+	Passing int
+	Warning int
+}
+
+// CheckID uniquely identifies a health check registered on a node.
+type CheckID string
+
+func (id CheckID) String() string {
+	return string(id)
+}
+
+// HealthCheck is a single health check's current result.
+type HealthCheck struct {
+	Node    string
+	CheckID CheckID
+	Status  string
+}
+
+// HealthChecks is a collection of HealthCheck results, typically for one
+// node or service.
+type HealthChecks []*HealthCheck
+
+// AggregatedStatus returns the single worst status among the checks: any
+// failing check makes the whole set "critical", any warning (with nothing
+// failing) makes it "warning", and an empty set is "passing".
+func (c HealthChecks) AggregatedStatus() string {
+	status := "passing"
+	for _, check := range c {
+		switch check.Status {
+		case "critical":
+			return "critical"
+		case "warning":
+			status = "warning"
+		}
+	}
+	return status
+}
+
+// Node is a registered Consul agent/node.
+type Node struct {
+	Node    string
+	Address string
+}
+
+// NodeService is a service instance as registered on a node.
+type NodeService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Weights Weights
+}
+
+// CheckServiceNode pairs a service instance with its node and the health
+// checks that apply to it.
+type CheckServiceNode struct {
+	Node    *Node
+	Service *NodeService
+	Checks  HealthChecks
+}
+
+// CheckServiceNodes is a list of service instances, typically the result of
+// a health query for one service.
+type CheckServiceNodes []CheckServiceNode
+
+// ServiceSpecificRequest is used to query for nodes providing a given
+// service.
+type ServiceSpecificRequest struct {
+	QueryOptions
+
+	Connect     bool
+	TagFilter   bool
+	ServiceName string
+	// ServiceTags are the tags a TagFilter lookup filters by. ServiceTag is
+	// the deprecated singular form, kept for backwards RPC compatibility
+	// with pre-1.3.x agents, and is used instead of ServiceTags when set.
+	ServiceTag      string
+	ServiceTags     []string
+	NodeMetaFilters map[string]string
+	Source          QuerySource
+	EnterpriseMeta  EnterpriseMeta
+
+	OrderOptions
+}
+
+// ChecksInStateRequest is used to query for checks in a given state.
+type ChecksInStateRequest struct {
+	QueryOptions
+
+	State           string
+	NodeMetaFilters map[string]string
+	Source          QuerySource
+	EnterpriseMeta  EnterpriseMeta
+}
+
+// NodeSpecificRequest is used to query for checks on a given node.
+type NodeSpecificRequest struct {
+	QueryOptions
+
+	Node           string
+	EnterpriseMeta EnterpriseMeta
+}
+
+// IndexedHealthChecks is a HealthChecks reply with the index it was read at
+// and, if the request paginated, the token for the next page.
+type IndexedHealthChecks struct {
+	HealthChecks HealthChecks
+	QueryMeta
+	PageMeta
+}
+
+// IndexedCheckServiceNodes is a CheckServiceNodes reply with the index it
+// was read at and, if the request paginated, the token for the next page.
+type IndexedCheckServiceNodes struct {
+	Nodes CheckServiceNodes
+	QueryMeta
+	PageMeta
+}
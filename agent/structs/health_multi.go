@@ -0,0 +1,21 @@
+package structs
+
+// ServiceListRequest is used to query CheckServiceNodes for several services
+// at once, computed against a single memdb snapshot.
+type ServiceListRequest struct {
+	QueryOptions
+
+	ServiceNames []string
+	// ServiceTagFilters optionally restricts each named service's results
+	// to instances carrying all of the listed tags.
+	ServiceTagFilters map[string][]string
+	EnterpriseMeta    EnterpriseMeta
+}
+
+// IndexedMultiCheckServiceNodes is the reply to MultiServiceNodes: every
+// requested service's CheckServiceNodes, computed against the same memdb
+// snapshot and reported under one combined index.
+type IndexedMultiCheckServiceNodes struct {
+	NodesByService map[string]CheckServiceNodes
+	QueryMeta
+}
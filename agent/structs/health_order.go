@@ -0,0 +1,21 @@
+package structs
+
+// OrderOptions selects an additional result-ordering mode for a
+// ServiceSpecificRequest, embedded there so these fields live alongside the
+// ordering feature that defines them rather than in the shared request
+// scaffolding in health.go.
+type OrderOptions struct {
+	// Order selects a result-ordering mode that is applied in place of the
+	// near= distance sort: "weighted-random" or "shuffle-shard". Empty means
+	// no additional ordering is applied and the near= sort is used.
+	Order string
+
+	// ShardKey is the rendezvous-hashing key used by Order ==
+	// "shuffle-shard" to deterministically select the same subset of
+	// instances across repeated calls from the same caller.
+	ShardKey string
+
+	// ShardSize caps how many instances Order == "shuffle-shard" returns.
+	// 0 means fall back to shuffleShardDefaultSize.
+	ShardSize int
+}
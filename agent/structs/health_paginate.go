@@ -0,0 +1,20 @@
+package structs
+
+// PageOptions requests a single bounded page of a potentially large result
+// set, embedded in QueryOptions. On a first page (PageToken == ""),
+// PageSize <= 0 means return everything, matching the pre-pagination
+// behavior. PageToken is the opaque cursor returned as NextPageToken by the
+// previous page, or "" for the first page; a continuation uses the page size
+// its cursor was started with, and one whose cursor is gone with
+// PageSize <= 0 is an error.
+type PageOptions struct {
+	PageSize  int
+	PageToken string
+}
+
+// PageMeta reports the continuation token for the next page of a paginated
+// reply, embedded in IndexedHealthChecks and IndexedCheckServiceNodes. It's
+// empty once a query's last page has been served.
+type PageMeta struct {
+	NextPageToken string
+}